@@ -0,0 +1,74 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Accelerator selects the QEMU hardware acceleration backend to request
+// via -accel.
+type Accelerator string
+
+const (
+	// AccelAuto probes the host and picks KVM/HVF when available,
+	// falling back to TCG otherwise. It is the zero value.
+	AccelAuto Accelerator = ""
+
+	// AccelKVM requests Linux KVM, falling back to TCG.
+	AccelKVM Accelerator = "kvm"
+
+	// AccelHVF requests macOS Hypervisor.framework, falling back to TCG.
+	AccelHVF Accelerator = "hvf"
+
+	// AccelTCG requests QEMU's software emulator only.
+	AccelTCG Accelerator = "tcg"
+)
+
+// resolve returns the concrete accelerator to use, probing the host when
+// a is AccelAuto.
+func (a Accelerator) resolve() Accelerator {
+	if a != AccelAuto {
+		return a
+	}
+	switch runtime.GOOS {
+	case "linux":
+		if haveKVM() {
+			return AccelKVM
+		}
+	case "darwin":
+		return AccelHVF
+	}
+	return AccelTCG
+}
+
+// haveKVM reports whether /dev/kvm is accessible, mirroring d2vm's
+// haveKVM check.
+func haveKVM() bool {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// accelArgs returns the -accel (and, where applicable, -cpu host) flags
+// for accelerator a, given the guest architecture it will run.
+func accelArgs(a Accelerator, guestArch GuestArch) []string {
+	accel := a.resolve()
+	if accel == AccelTCG {
+		return []string{"-accel", "tcg"}
+	}
+
+	args := []string{"-accel", fmt.Sprintf("%s:tcg", accel)}
+	hostArch, ok := goarchToGuestArch[runtime.GOARCH]
+	if ok && hostArch == guestArch {
+		args = append(args, "-cpu", "host")
+	}
+	return args
+}
@@ -0,0 +1,37 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestAccelArgsTCG(t *testing.T) {
+	got := accelArgs(AccelTCG, GuestArchX8664)
+	want := []string{"-accel", "tcg"}
+	if len(got) != len(want) {
+		t.Fatalf("accelArgs(AccelTCG) = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("accelArgs(AccelTCG) = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestAccelArgsCPUHostOnlyOnMatchingArch(t *testing.T) {
+	hostArch, ok := goarchToGuestArch[runtime.GOARCH]
+	if !ok {
+		t.Skip("unsupported host arch for this test")
+	}
+
+	if got := accelArgs(AccelKVM, hostArch); len(got) != 4 {
+		t.Errorf("accelArgs(AccelKVM, hostArch) = %v, want -accel kvm:tcg -cpu host", got)
+	}
+	if got := accelArgs(AccelKVM, GuestArch("bogus")); len(got) != 2 {
+		t.Errorf("accelArgs(AccelKVM, bogus) = %v, want just -accel kvm:tcg", got)
+	}
+}
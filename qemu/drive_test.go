@@ -0,0 +1,69 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import "testing"
+
+func TestDriveCmdline(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		d    Drive
+		want []cmdlineEqualOpt
+	}{
+		{
+			name: "defaults",
+			d:    Drive{Path: "./disk.img"},
+			want: []cmdlineEqualOpt{
+				withArg("-drive", "file=./disk.img,if=none,format=raw,id=drive0"),
+				withArg("-device", "virtio-blk-pci,drive=drive0"),
+			},
+		},
+		{
+			name: "qcow2-ide-readonly-snapshot",
+			d: Drive{
+				Path:      "./disk.qcow2",
+				Format:    FormatQCOW2,
+				Interface: InterfaceIDE,
+				ReadOnly:  true,
+				Snapshot:  true,
+			},
+			want: []cmdlineEqualOpt{
+				withArg("-drive", "file=./disk.qcow2,if=none,format=qcow2,id=drive0,readonly=on,snapshot=on"),
+				withArg("-device", "ich9-ahci,id=ahci0"),
+				withArg("-device", "ide-hd,drive=drive0,bus=ahci0.0"),
+			},
+		},
+		{
+			name: "scsi",
+			d: Drive{
+				Path:      "./disk.img",
+				Interface: InterfaceSCSI,
+			},
+			want: []cmdlineEqualOpt{
+				withArg("-drive", "file=./disk.img,if=none,format=raw,id=drive0"),
+				withArg("-device", "virtio-scsi-pci,id=scsi0"),
+				withArg("-device", "scsi-hd,drive=drive0,bus=scsi0.0"),
+			},
+		},
+		{
+			name: "nvme",
+			d: Drive{
+				Path:      "./disk.img",
+				Interface: InterfaceNVMe,
+			},
+			want: []cmdlineEqualOpt{
+				withArg("-drive", "file=./disk.img,if=none,format=raw,id=drive0"),
+				withArg("-device", "nvme,drive=drive0,serial=drive0"),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := append([]string{"argv0"}, tt.d.Cmdline(NewIDAllocator())...)
+			if err := isCmdlineEqual(got, append([]cmdlineEqualOpt{withArgv0("argv0")}, tt.want...)...); err != nil {
+				t.Errorf("Cmdline = %v", err)
+			}
+		})
+	}
+}
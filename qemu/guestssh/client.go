@@ -0,0 +1,136 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guestssh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/hugelgupf/vmtest/qemu"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultForwardName is the UserNetwork ForwardRule.Name expected by
+// Dial, matching the convention used by vm.ForwardedPort("ssh").
+const DefaultForwardName = "ssh"
+
+// DefaultUser is the guest user Dial authenticates as.
+const DefaultUser = "root"
+
+// Client drives a guest over SSH, reachable via a VM's forwarded SSH
+// port, as an alternative to scraping serial console output with
+// Console.ExpectString.
+type Client struct {
+	*ssh.Client
+}
+
+// Dial waits for the guest's forwarded SSH port to come up and
+// authenticates as user using kp, matching the authorized key staged by
+// InjectAuthorizedKey. It retries until ctx is done.
+func Dial(ctx context.Context, vm *qemu.VM, kp *KeyPair, user string) (*Client, error) {
+	if user == "" {
+		user = DefaultUser
+	}
+	addr, ok := vm.ForwardedPort(DefaultForwardName)
+	if !ok {
+		return nil, fmt.Errorf("guestssh: no %q forwarded port on VM; configure a qemu.UserNetwork rule named %q", DefaultForwardName, DefaultForwardName)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(kp.Signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec // guest host key is unknown and unverifiable by design
+		Timeout:         5 * time.Second,
+	}
+
+	var lastErr error
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("guestssh: dialing %s: %w (last error: %v)", addr, ctx.Err(), lastErr)
+		default:
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			lastErr = err
+			time.Sleep(250 * time.Millisecond)
+			continue
+		}
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err != nil {
+			lastErr = err
+			conn.Close()
+			time.Sleep(250 * time.Millisecond)
+			continue
+		}
+		return &Client{Client: ssh.NewClient(c, chans, reqs)}, nil
+	}
+}
+
+// Run executes cmd in the guest and returns its combined stdout/stderr.
+func (c *Client) Run(ctx context.Context, cmd string) (string, error) {
+	sess, err := c.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("guestssh: new session: %w", err)
+	}
+	defer sess.Close()
+
+	done := make(chan struct{})
+	var out bytes.Buffer
+	var runErr error
+	sess.Stdout = &out
+	sess.Stderr = &out
+	go func() {
+		runErr = sess.Run(cmd)
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		// Best-effort: ask the remote command to die. Most sshd
+		// implementations don't honor client-sent signals for exec
+		// sessions, so don't rely on it.
+		sess.Signal(ssh.SIGKILL)
+		// Close the session's channel to force sess.Run to return,
+		// since the remote command may ignore the signal above and
+		// run forever. This also unblocks the goroutine writing to
+		// out, so it's safe to read below.
+		sess.Close()
+		<-done
+		return out.String(), ctx.Err()
+	case <-done:
+		return out.String(), runErr
+	}
+}
+
+// CopyFile writes r's contents to path in the guest with the given
+// permission mode (e.g. 0o644), using `install -D` reading from stdin
+// over an SSH session rather than a separate SFTP/SCP subsystem.
+func (c *Client) CopyFile(ctx context.Context, r io.Reader, path string, mode uint32) error {
+	sess, err := c.NewSession()
+	if err != nil {
+		return fmt.Errorf("guestssh: new session: %w", err)
+	}
+	defer sess.Close()
+
+	sess.Stdin = r
+	cmd := fmt.Sprintf("install -D -m %o /dev/stdin %s", mode, path)
+
+	done := make(chan error, 1)
+	go func() { done <- sess.Run(cmd) }()
+
+	select {
+	case <-ctx.Done():
+		sess.Signal(ssh.SIGKILL)
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guestssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dialFakeSSHServer starts a minimal in-process SSH server that accepts
+// any auth attempt and runs execFunc for every session's "exec" request,
+// then returns a *Client dialed against it.
+func dialFakeSSHServer(t *testing.T, execFunc func(cmd string)) *Client {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating host key: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("converting host key: %v", err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		sc, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		defer sc.Close()
+		go ssh.DiscardRequests(reqs)
+
+		for newCh := range chans {
+			if newCh.ChannelType() != "session" {
+				newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+				continue
+			}
+			ch, requests, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ch.Close()
+				for req := range requests {
+					if req.Type != "exec" {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+					execFunc(string(req.Payload[4:]))
+					ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+					return
+				}
+			}()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing fake server: %v", err)
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.Password("")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec // test-only fake server
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	return &Client{Client: ssh.NewClient(c, chans, reqs)}
+}
+
+// TestClientRunCancelDoesNotRaceOutput exercises Run's ctx-cancellation
+// path under the race detector: it must not read the shared output
+// buffer while the background sess.Run goroutine is still writing to it.
+func TestClientRunCancelDoesNotRaceOutput(t *testing.T) {
+	c := dialFakeSSHServer(t, func(cmd string) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.Run(ctx, "sleep 1"); err == nil {
+		t.Error("Run with expired ctx = nil error, want error")
+	}
+}
+
+// TestClientRunCancelUnblocksIfSignalIgnored guards against relying
+// solely on sess.Signal to stop the remote command: most real sshd
+// implementations don't honor client-sent signals for exec sessions, so
+// Run must still return once ctx is done even if the command never
+// exits on its own.
+func TestClientRunCancelUnblocksIfSignalIgnored(t *testing.T) {
+	c := dialFakeSSHServer(t, func(cmd string) {
+		select {} // never returns; simulates a signal-ignoring sshd
+	})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx, "sleep 1000")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after ctx expired and the remote command ignored the signal")
+	}
+}
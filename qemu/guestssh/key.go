@@ -0,0 +1,45 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package guestssh drives a guest over SSH, using a VM's forwarded SSH
+// port instead of scraping serial console output.
+package guestssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyPair is an ephemeral SSH host-independent keypair generated for a
+// single VM's lifetime: the public half is injected into the guest as an
+// authorized key, and the private half is used to authenticate the
+// client side.
+type KeyPair struct {
+	Signer    ssh.Signer
+	PublicKey []byte // authorized_keys format, newline-terminated
+}
+
+// GenerateKeyPair creates a fresh ed25519 keypair for authenticating to a
+// single guest.
+func GenerateKeyPair() (*KeyPair, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating SSH keypair: %w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("converting SSH key: %w", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("converting SSH public key: %w", err)
+	}
+	return &KeyPair{
+		Signer:    signer,
+		PublicKey: ssh.MarshalAuthorizedKey(sshPub),
+	}, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guestssh
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateKeyPair(t *testing.T) {
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	if kp.Signer == nil {
+		t.Fatal("GenerateKeyPair did not set Signer")
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(kp.PublicKey)
+	if err != nil {
+		t.Fatalf("PublicKey is not valid authorized_keys format: %v", err)
+	}
+	if !strings.EqualFold(string(pub.Marshal()), string(kp.Signer.PublicKey().Marshal())) {
+		t.Error("PublicKey does not match Signer's public key")
+	}
+
+	kp2, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	if string(kp.PublicKey) == string(kp2.PublicKey) {
+		t.Error("two calls to GenerateKeyPair produced the same key")
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guestssh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/u-root/u-root/pkg/uroot"
+)
+
+// AuthorizedKeysPath is where InjectAuthorizedKey places the public key
+// inside the guest's root filesystem.
+const AuthorizedKeysPath = "/root/.ssh/authorized_keys"
+
+// InjectAuthorizedKey stages pubKey as root's authorized_keys file in the
+// initramfs built by o, so that an in-guest sshd started by the uinit
+// will accept the matching private key. It must be called before
+// uroot.CreateInitramfs.
+func InjectAuthorizedKey(o *uroot.Opts, pubKey []byte) error {
+	if o.TempDir == "" {
+		return fmt.Errorf("guestssh: uroot.Opts.TempDir must be set before InjectAuthorizedKey")
+	}
+
+	hostPath := filepath.Join(o.TempDir, "authorized_keys")
+	if err := os.WriteFile(hostPath, pubKey, 0o600); err != nil {
+		return fmt.Errorf("writing authorized_keys: %w", err)
+	}
+
+	o.ExtraFiles = append(o.ExtraFiles, fmt.Sprintf("%s:%s", hostPath, AuthorizedKeysPath))
+	return nil
+}
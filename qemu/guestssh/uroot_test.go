@@ -0,0 +1,45 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package guestssh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/uroot"
+)
+
+func TestInjectAuthorizedKeyRequiresTempDir(t *testing.T) {
+	o := &uroot.Opts{}
+	if err := InjectAuthorizedKey(o, []byte("ssh-ed25519 AAAA test\n")); err == nil {
+		t.Error("InjectAuthorizedKey with no TempDir = nil error, want error")
+	}
+}
+
+func TestInjectAuthorizedKey(t *testing.T) {
+	o := &uroot.Opts{TempDir: t.TempDir()}
+	pubKey := []byte("ssh-ed25519 AAAA test\n")
+
+	if err := InjectAuthorizedKey(o, pubKey); err != nil {
+		t.Fatalf("InjectAuthorizedKey: %v", err)
+	}
+
+	if len(o.ExtraFiles) != 1 {
+		t.Fatalf("ExtraFiles = %v, want 1 entry", o.ExtraFiles)
+	}
+	want := filepath.Join(o.TempDir, "authorized_keys") + ":" + AuthorizedKeysPath
+	if o.ExtraFiles[0] != want {
+		t.Errorf("ExtraFiles[0] = %q, want %q", o.ExtraFiles[0], want)
+	}
+
+	got, err := os.ReadFile(filepath.Join(o.TempDir, "authorized_keys"))
+	if err != nil {
+		t.Fatalf("reading staged authorized_keys: %v", err)
+	}
+	if string(got) != string(pubKey) {
+		t.Errorf("staged authorized_keys = %q, want %q", got, pubKey)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import "strings"
+
+// Mitigations is a KArgsDevice that translates boolean toggles into the
+// kernel command-line fragments (and -cpu flags) needed to switch
+// hardening/exploit-mitigation features on or off, giving tests a typed
+// API instead of hand-concatenated kernel args for this purpose.
+//
+// All fields default to false, i.e. "leave the kernel's default alone".
+// Setting a field to true disables that mitigation.
+type Mitigations struct {
+	DisableKASLR bool
+	DisableSMEP  bool
+	DisableSMAP  bool
+	DisableKPTI  bool
+
+	// DisableSpectreV2 turns off the Spectre v2 (branch target
+	// injection) mitigation via spectre_v2=off.
+	DisableSpectreV2 bool
+
+	// Accelerator is overwritten by Options.Cmdline with the Options'
+	// own Accelerator before Cmdline runs; it isn't meant to be set
+	// directly (except in tests exercising Cmdline in isolation).
+	// -cpu host, needed to pass the SMEP/SMAP toggles below through to
+	// the guest, is only accepted by QEMU when it's actually using KVM
+	// or HVF; under TCG it errors out, so Cmdline falls back to a
+	// software CPU model there.
+	Accelerator Accelerator
+}
+
+// KArgs implements KArgsDevice.
+func (m Mitigations) KArgs() []string {
+	var args []string
+	if m.DisableKASLR {
+		args = append(args, "nokaslr")
+	}
+	if m.DisableSMEP {
+		args = append(args, "nosmep")
+	}
+	if m.DisableSMAP {
+		args = append(args, "nosmap")
+	}
+	if m.DisableKPTI {
+		args = append(args, "nopti")
+	}
+	if m.DisableSpectreV2 {
+		args = append(args, "spectre_v2=off")
+	}
+	return args
+}
+
+// Cmdline implements Device. Mitigations also requests -cpu flags to
+// disable SMEP/SMAP at the CPU model level, since nosmep/nosmap alone
+// only tell the kernel not to rely on them; QEMU still needs to expose
+// a CPU model that has them toggled off for exploit-reproduction
+// purposes.
+func (m Mitigations) Cmdline(*IDAllocator) []string {
+	var features []string
+	if m.DisableSMEP {
+		features = append(features, "-smep")
+	}
+	if m.DisableSMAP {
+		features = append(features, "-smap")
+	}
+	if len(features) == 0 {
+		return nil
+	}
+	model := "qemu64"
+	if accel := m.Accelerator.resolve(); accel == AccelKVM || accel == AccelHVF {
+		model = "host"
+	}
+	return []string{"-cpu", model + "," + strings.Join(features, ",")}
+}
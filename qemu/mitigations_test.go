@@ -0,0 +1,73 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import "testing"
+
+func TestMitigationsKArgs(t *testing.T) {
+	m := Mitigations{
+		DisableKASLR:     true,
+		DisableSMEP:      true,
+		DisableSMAP:      true,
+		DisableKPTI:      true,
+		DisableSpectreV2: true,
+	}
+	want := []string{"nokaslr", "nosmep", "nosmap", "nopti", "spectre_v2=off"}
+	got := m.KArgs()
+	if len(got) != len(want) {
+		t.Fatalf("KArgs = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("KArgs = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMitigationsCPUFlags(t *testing.T) {
+	got := Mitigations{DisableSMEP: true, DisableSMAP: true, Accelerator: AccelTCG}.Cmdline(NewIDAllocator())
+	if err := isCmdlineEqual(append([]string{"argv0"}, got...), withArgv0("argv0"), withArg("-cpu", "qemu64,-smep,-smap")); err != nil {
+		t.Errorf("Cmdline = %v", err)
+	}
+
+	got = Mitigations{DisableSMEP: true, DisableSMAP: true, Accelerator: AccelKVM}.Cmdline(NewIDAllocator())
+	if err := isCmdlineEqual(append([]string{"argv0"}, got...), withArgv0("argv0"), withArg("-cpu", "host,-smep,-smap")); err != nil {
+		t.Errorf("Cmdline = %v", err)
+	}
+
+	if got := (Mitigations{}).Cmdline(NewIDAllocator()); got != nil {
+		t.Errorf("Cmdline with no CPU-level toggles = %v, want nil", got)
+	}
+}
+
+// TestOptionsCmdlineWiresAcceleratorIntoMitigations guards against the
+// Mitigations.Accelerator field going stale: Options.Cmdline must set it
+// from the Options' own Accelerator, not trust whatever (if anything)
+// the caller set directly on the device.
+func TestOptionsCmdlineWiresAcceleratorIntoMitigations(t *testing.T) {
+	// The device claims AccelKVM, but Options says AccelTCG; Cmdline
+	// must go with the Options value, not the stale one on the device.
+	o := &Options{
+		QEMUPath:    "qemu",
+		QEMUArch:    GuestArchX8664,
+		Kernel:      "./foobar",
+		Accelerator: AccelTCG,
+		Devices:     []Device{Mitigations{DisableSMEP: true, Accelerator: AccelKVM}},
+	}
+	got, err := o.Cmdline()
+	if err != nil {
+		t.Fatalf("Cmdline: %v", err)
+	}
+	if err := isCmdlineEqual(got,
+		withArgv0("qemu"),
+		withArg("-nographic"),
+		withArg("-kernel", "./foobar"),
+		withArg("-accel", "tcg"),
+		withArg("-cpu", "qemu64,-smep"),
+		withArg("-append", "nosmep"),
+	); err != nil {
+		t.Errorf("Cmdline = %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ForwardRule describes a single user-mode (SLIRP) hostfwd rule: traffic
+// to HostAddr:HostPort on the host is forwarded to GuestPort in the
+// guest. Name identifies the rule so a test can look up the resolved
+// host address later via VM.ForwardedPort, e.g. ForwardRule{Name: "ssh",
+// GuestPort: 22}.
+type ForwardRule struct {
+	Name string
+
+	// Proto is "tcp" or "udp". Defaults to "tcp".
+	Proto string
+
+	// HostAddr is the host address to bind. Defaults to 127.0.0.1.
+	HostAddr string
+
+	// HostPort is the host port to forward from. If zero, an ephemeral
+	// port is chosen by binding and releasing a socket, and the
+	// resolved value is available afterwards via VM.ForwardedPort.
+	HostPort uint16
+
+	GuestPort uint16
+}
+
+// UserNetwork configures QEMU user-mode (SLIRP) networking, i.e.
+// `-netdev user,id=...[,hostfwd=...] -device virtio-net-pci,netdev=...`.
+// It requires no host-side privileges or setup, unlike TAPNetwork and
+// BridgeNetwork, at the cost of guest-to-guest and inbound connectivity
+// being limited to the configured forwarding Rules.
+type UserNetwork struct {
+	Rules []ForwardRule
+
+	resolved map[string]string
+}
+
+// Cmdline implements Device. It also resolves any HostPort: 0 rules to
+// an ephemeral port by briefly binding and releasing a socket, so the
+// chosen port is available from VM.ForwardedPort once Start returns.
+func (n *UserNetwork) Cmdline(alloc *IDAllocator) []string {
+	id := fmt.Sprintf("net%d", alloc.ID("netdev"))
+
+	netdev := []string{"user", "id=" + id}
+	n.resolved = make(map[string]string, len(n.Rules))
+	for i, rule := range n.Rules {
+		proto := rule.Proto
+		if proto == "" {
+			proto = "tcp"
+		}
+		hostAddr := rule.HostAddr
+		if hostAddr == "" {
+			hostAddr = "127.0.0.1"
+		}
+		hostPort := rule.HostPort
+		if hostPort == 0 {
+			if p, err := allocateEphemeralPort(proto, hostAddr); err == nil {
+				hostPort = p
+			}
+		}
+		n.Rules[i].HostPort = hostPort
+
+		if rule.Name != "" {
+			n.resolved[rule.Name] = net.JoinHostPort(hostAddr, fmt.Sprint(hostPort))
+		}
+		netdev = append(netdev, fmt.Sprintf("hostfwd=%s:%s:%d-:%d", proto, hostAddr, hostPort, rule.GuestPort))
+	}
+
+	return []string{
+		"-netdev", strings.Join(netdev, ","),
+		"-device", "virtio-net-pci,netdev=" + id,
+	}
+}
+
+// ForwardedAddr implements portForwarder.
+func (n *UserNetwork) ForwardedAddr(name string) (string, bool) {
+	addr, ok := n.resolved[name]
+	return addr, ok
+}
+
+// allocateEphemeralPort picks a free host port by binding and
+// immediately releasing a socket on addr.
+func allocateEphemeralPort(proto, addr string) (uint16, error) {
+	switch proto {
+	case "udp":
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(addr, "0"))
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		return portOf(conn.LocalAddr().String())
+	default:
+		l, err := net.Listen("tcp", net.JoinHostPort(addr, "0"))
+		if err != nil {
+			return 0, err
+		}
+		defer l.Close()
+		return portOf(l.Addr().String())
+	}
+}
+
+func portOf(hostport string) (uint16, error) {
+	_, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return 0, err
+	}
+	var port uint16
+	if _, err := fmt.Sscanf(portStr, "%d", &port); err != nil {
+		return 0, err
+	}
+	return port, nil
+}
+
+// TAPNetwork attaches a pre-existing, persistent TAP interface to the
+// guest, i.e. `-netdev tap,ifname=...,script=no,downscript=no -device
+// virtio-net-pci,netdev=...`, matching the networking mode used by d2vm
+// and syzkaller's qemu driver. The interface must already exist and be
+// configured on the host; script/downscript are disabled since vmtest
+// does not manage host networking itself.
+type TAPNetwork struct {
+	IfName string
+	MAC    string
+}
+
+// Cmdline implements Device.
+func (n TAPNetwork) Cmdline(alloc *IDAllocator) []string {
+	id := fmt.Sprintf("net%d", alloc.ID("netdev"))
+	device := fmt.Sprintf("virtio-net-pci,netdev=%s", id)
+	if n.MAC != "" {
+		device += ",mac=" + n.MAC
+	}
+	return []string{
+		"-netdev", fmt.Sprintf("tap,id=%s,ifname=%s,script=no,downscript=no", id, n.IfName),
+		"-device", device,
+	}
+}
+
+// BridgeNetwork attaches the guest to an existing host bridge, i.e.
+// `-netdev bridge,br=...`, for setups where TAP interfaces are plugged
+// into a bridge out-of-band rather than used point-to-point.
+type BridgeNetwork struct {
+	// Bridge is the host bridge name. Defaults to "br0".
+	Bridge string
+	MAC    string
+}
+
+// Cmdline implements Device.
+func (n BridgeNetwork) Cmdline(alloc *IDAllocator) []string {
+	bridge := n.Bridge
+	if bridge == "" {
+		bridge = "br0"
+	}
+	id := fmt.Sprintf("net%d", alloc.ID("netdev"))
+	device := fmt.Sprintf("virtio-net-pci,netdev=%s", id)
+	if n.MAC != "" {
+		device += ",mac=" + n.MAC
+	}
+	return []string{
+		"-netdev", fmt.Sprintf("bridge,id=%s,br=%s", id, bridge),
+		"-device", device,
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import "testing"
+
+func TestUserNetworkCmdline(t *testing.T) {
+	n := &UserNetwork{
+		Rules: []ForwardRule{
+			{Name: "ssh", HostAddr: "127.0.0.1", HostPort: 2222, GuestPort: 22},
+		},
+	}
+	got := append([]string{"argv0"}, n.Cmdline(NewIDAllocator())...)
+	want := []cmdlineEqualOpt{
+		withArgv0("argv0"),
+		withArg("-netdev", "user,id=net0,hostfwd=tcp:127.0.0.1:2222-:22"),
+		withArg("-device", "virtio-net-pci,netdev=net0"),
+	}
+	if err := isCmdlineEqual(got, want...); err != nil {
+		t.Errorf("Cmdline = %v", err)
+	}
+}
+
+func TestUserNetworkForwardedAddr(t *testing.T) {
+	n := &UserNetwork{
+		Rules: []ForwardRule{
+			{Name: "ssh", HostAddr: "127.0.0.1", HostPort: 2222, GuestPort: 22},
+		},
+	}
+	n.Cmdline(NewIDAllocator())
+
+	addr, ok := n.ForwardedAddr("ssh")
+	if !ok || addr != "127.0.0.1:2222" {
+		t.Errorf("ForwardedAddr(ssh) = %q, %v, want 127.0.0.1:2222, true", addr, ok)
+	}
+
+	if _, ok := n.ForwardedAddr("nonexistent"); ok {
+		t.Error("ForwardedAddr(nonexistent) = true, want false")
+	}
+}
+
+func TestUserNetworkResolvesEphemeralPort(t *testing.T) {
+	n := &UserNetwork{
+		Rules: []ForwardRule{{Name: "http", GuestPort: 80}},
+	}
+	n.Cmdline(NewIDAllocator())
+
+	addr, ok := n.ForwardedAddr("http")
+	if !ok {
+		t.Fatal("ForwardedAddr(http) not resolved")
+	}
+	if addr == "127.0.0.1:0" {
+		t.Errorf("ForwardedAddr(http) = %q, want a resolved ephemeral port", addr)
+	}
+}
+
+func TestTAPNetworkCmdline(t *testing.T) {
+	n := TAPNetwork{IfName: "vmtap0", MAC: "52:54:00:12:34:56"}
+	got := append([]string{"argv0"}, n.Cmdline(NewIDAllocator())...)
+	want := []cmdlineEqualOpt{
+		withArgv0("argv0"),
+		withArg("-netdev", "tap,id=net0,ifname=vmtap0,script=no,downscript=no"),
+		withArg("-device", "virtio-net-pci,netdev=net0,mac=52:54:00:12:34:56"),
+	}
+	if err := isCmdlineEqual(got, want...); err != nil {
+		t.Errorf("Cmdline = %v", err)
+	}
+}
+
+func TestBridgeNetworkCmdline(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		n    BridgeNetwork
+		want []cmdlineEqualOpt
+	}{
+		{
+			name: "defaults",
+			n:    BridgeNetwork{},
+			want: []cmdlineEqualOpt{
+				withArg("-netdev", "bridge,id=net0,br=br0"),
+				withArg("-device", "virtio-net-pci,netdev=net0"),
+			},
+		},
+		{
+			name: "custom bridge and mac",
+			n:    BridgeNetwork{Bridge: "br1", MAC: "52:54:00:12:34:56"},
+			want: []cmdlineEqualOpt{
+				withArg("-netdev", "bridge,id=net0,br=br1"),
+				withArg("-device", "virtio-net-pci,netdev=net0,mac=52:54:00:12:34:56"),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := append([]string{"argv0"}, tt.n.Cmdline(NewIDAllocator())...)
+			if err := isCmdlineEqual(got, append([]cmdlineEqualOpt{withArgv0("argv0")}, tt.want...)...); err != nil {
+				t.Errorf("Cmdline = %v", err)
+			}
+		})
+	}
+}
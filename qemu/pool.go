@@ -0,0 +1,154 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// Pool hands out *VM instances built from a fixed set of Options
+// templates, bounding how many run concurrently and uniquifying the
+// per-VM state (forwarded ports, SMBIOS UUIDs, TAP interface names,
+// scratch disk/temp directories) that would otherwise collide when many
+// VMs from the same template run at once. This is the equivalent of
+// out-of-tree's --threads=N and syzkaller's Count, letting `go test
+// -parallel` actually parallelize VM-backed subtests.
+type Pool struct {
+	templates []Options
+	tokens    chan struct{}
+	next      atomic.Uint64
+}
+
+// NewPool returns a Pool that leases VMs built from templates, running
+// at most max of them at once. If max is 0, it falls back to the
+// VMTEST_PARALLEL environment variable, and then to 1.
+func NewPool(max int, templates ...Options) (*Pool, error) {
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("qemu: Pool needs at least one Options template")
+	}
+	if max == 0 {
+		if env := os.Getenv("VMTEST_PARALLEL"); env != "" {
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				return nil, fmt.Errorf("qemu: invalid VMTEST_PARALLEL %q: %w", env, err)
+			}
+			max = n
+		} else {
+			max = 1
+		}
+	}
+	return &Pool{
+		templates: templates,
+		tokens:    make(chan struct{}, max),
+	}, nil
+}
+
+// Acquire blocks until a concurrency slot is free (or ctx is done), then
+// starts a VM from one of the pool's templates, uniquified so it doesn't
+// collide with any other VM the pool has concurrently leased out.
+// Release must be called once the VM is no longer needed.
+func (p *Pool) Acquire(ctx context.Context) (*VM, error) {
+	select {
+	case p.tokens <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	idx := p.next.Add(1) - 1
+	o, tmp, err := p.uniquify(p.templates[int(idx)%len(p.templates)], idx)
+	if err != nil {
+		<-p.tokens
+		return nil, err
+	}
+
+	vm, err := o.Start()
+	if err != nil {
+		os.RemoveAll(tmp)
+		<-p.tokens
+		return nil, err
+	}
+	vm.poolTempDir = tmp
+	return vm, nil
+}
+
+// Release returns vm's concurrency slot to the pool and removes the
+// private temp dir Acquire created for it.
+func (p *Pool) Release(vm *VM) {
+	if vm.poolTempDir != "" {
+		os.RemoveAll(vm.poolTempDir)
+	}
+	<-p.tokens
+}
+
+// uniquify returns a copy of o suitable for running as the n'th leased
+// VM, with state that must not collide across concurrent VMs rewritten:
+// a fresh SMBIOS UUID (unless the template already sets one, which is
+// kept as is), unique TAP interface names, scratch disk paths
+// (Drives with Size set, i.e. ones Start will create from scratch)
+// relocated into a private temp dir, which is also returned so the
+// caller can remove it once the VM is released, and QMP devices cloned
+// so concurrent Starts don't race on the same *QMP's SocketPath/
+// generatedDir fields. Drives pointing at a pre-built, non-scratch
+// image, and QMP devices with an explicit caller-supplied SocketPath,
+// are left alone.
+func (p *Pool) uniquify(o Options, n uint64) (Options, string, error) {
+	tmp, err := os.MkdirTemp("", fmt.Sprintf("vmtest-pool%d-", n))
+	if err != nil {
+		return Options{}, "", fmt.Errorf("qemu: creating pool VM temp dir: %w", err)
+	}
+
+	clone := o
+	if clone.UUID == "" {
+		uuid, err := newUUID()
+		if err != nil {
+			os.RemoveAll(tmp)
+			return Options{}, "", err
+		}
+		clone.UUID = uuid
+	}
+
+	clone.Devices = make([]Device, len(o.Devices))
+	for i, d := range o.Devices {
+		switch dv := d.(type) {
+		case *UserNetwork:
+			nd := *dv
+			nd.Rules = append([]ForwardRule(nil), dv.Rules...)
+			clone.Devices[i] = &nd
+		case TAPNetwork:
+			dv.IfName = fmt.Sprintf("%s%d", dv.IfName, n)
+			clone.Devices[i] = dv
+		case Drive:
+			if dv.Size != "" {
+				dv.Path = filepath.Join(tmp, filepath.Base(dv.Path))
+			}
+			clone.Devices[i] = dv
+		case *QMP:
+			nq := *dv
+			clone.Devices[i] = &nq
+		default:
+			clone.Devices[i] = d
+		}
+	}
+
+	return clone, tmp, nil
+}
+
+// newUUID returns a random RFC 4122 version 4 UUID string, suitable for
+// -uuid.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("generating UUID: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolUniquifyRewritesCollidingState(t *testing.T) {
+	p, err := NewPool(2, Options{
+		Devices: []Device{
+			TAPNetwork{IfName: "vmtap"},
+			Drive{Path: "/tmp/disk.img", Size: "1G"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	a, tmpA, err := p.uniquify(p.templates[0], 0)
+	if err != nil {
+		t.Fatalf("uniquify(0): %v", err)
+	}
+	defer os.RemoveAll(tmpA)
+	b, tmpB, err := p.uniquify(p.templates[0], 1)
+	if err != nil {
+		t.Fatalf("uniquify(1): %v", err)
+	}
+	defer os.RemoveAll(tmpB)
+
+	if a.UUID == "" || b.UUID == "" || a.UUID == b.UUID {
+		t.Errorf("UUIDs not unique: %q, %q", a.UUID, b.UUID)
+	}
+
+	aTAP := a.Devices[0].(TAPNetwork)
+	bTAP := b.Devices[0].(TAPNetwork)
+	if aTAP.IfName == bTAP.IfName {
+		t.Errorf("TAP ifnames not unique: %q, %q", aTAP.IfName, bTAP.IfName)
+	}
+
+	aDrive := a.Devices[1].(Drive)
+	bDrive := b.Devices[1].(Drive)
+	if aDrive.Path == bDrive.Path {
+		t.Errorf("Drive paths not unique: %q, %q", aDrive.Path, bDrive.Path)
+	}
+}
+
+func TestPoolUniquifyLeavesNonScratchDriveAlone(t *testing.T) {
+	p, err := NewPool(1, Options{
+		Devices: []Device{Drive{Path: "/srv/golden/base.qcow2"}},
+	})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	o, tmp, err := p.uniquify(p.templates[0], 0)
+	if err != nil {
+		t.Fatalf("uniquify: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	got := o.Devices[0].(Drive).Path
+	if got != "/srv/golden/base.qcow2" {
+		t.Errorf("non-scratch Drive.Path rewritten: got %q, want unchanged", got)
+	}
+}
+
+func TestPoolUniquifyClonesQMP(t *testing.T) {
+	q := &QMP{}
+	p, err := NewPool(2, Options{Devices: []Device{q}})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	a, tmpA, err := p.uniquify(p.templates[0], 0)
+	if err != nil {
+		t.Fatalf("uniquify(0): %v", err)
+	}
+	defer os.RemoveAll(tmpA)
+	b, tmpB, err := p.uniquify(p.templates[0], 1)
+	if err != nil {
+		t.Fatalf("uniquify(1): %v", err)
+	}
+	defer os.RemoveAll(tmpB)
+
+	aq := a.Devices[0].(*QMP)
+	bq := b.Devices[0].(*QMP)
+	if aq == q || bq == q || aq == bq {
+		t.Fatal("uniquify did not clone the *QMP device; clones share the template's pointer")
+	}
+}
+
+// writeSleeperScript writes a shell script that sleeps briefly
+// regardless of the (QEMU-shaped) arguments it's called with, so
+// Pool.Acquire/Release can be exercised end-to-end without a real QEMU
+// binary.
+func writeSleeperScript(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sleeper.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nsleep 0.2\n"), 0o755); err != nil {
+		t.Fatalf("writing sleeper script: %v", err)
+	}
+	return path
+}
+
+func TestPoolAcquireBoundsConcurrency(t *testing.T) {
+	const max = 2
+	p, err := NewPool(max, Options{QEMUPath: writeSleeperScript(t)})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var inFlight, maxObserved atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < max*3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vm, err := p.Acquire(ctx)
+			if err != nil {
+				t.Errorf("Acquire: %v", err)
+				return
+			}
+			n := inFlight.Add(1)
+			for {
+				old := maxObserved.Load()
+				if n <= old || maxObserved.CompareAndSwap(old, n) {
+					break
+				}
+			}
+			vm.Wait()
+			inFlight.Add(-1)
+			p.Release(vm)
+		}()
+	}
+	wg.Wait()
+
+	if got := maxObserved.Load(); got > max {
+		t.Errorf("observed %d VMs in flight at once, want <= %d", got, max)
+	}
+}
+
+func TestPoolReleaseRemovesTempDir(t *testing.T) {
+	p, err := NewPool(1, Options{QEMUPath: writeSleeperScript(t)})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	vm, err := p.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	tmp := vm.poolTempDir
+	if tmp == "" {
+		t.Fatal("Acquire did not set poolTempDir")
+	}
+	vm.Wait()
+	p.Release(vm)
+
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("Release did not remove %s: %v", tmp, err)
+	}
+}
+
+func TestPoolAcquireConcurrentQMPDevices(t *testing.T) {
+	p, err := NewPool(2, Options{
+		QEMUPath: writeSleeperScript(t),
+		Devices:  []Device{&QMP{}},
+	})
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	sockets := make([]string, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vm, err := p.Acquire(ctx)
+			if err != nil {
+				t.Errorf("Acquire: %v", err)
+				return
+			}
+			sockets[i] = vm.qmpSocket
+			vm.Wait()
+			p.Release(vm)
+		}(i)
+	}
+	wg.Wait()
+
+	if sockets[0] == "" || sockets[1] == "" {
+		t.Fatal("Acquire did not set qmpSocket on a concurrently leased VM")
+	}
+	if sockets[0] == sockets[1] {
+		t.Errorf("two concurrently leased VMs share the same QMP socket %q", sockets[0])
+	}
+}
@@ -0,0 +1,577 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qemu builds QEMU command lines and manages QEMU-based virtual
+// machines for use in Go tests.
+package qemu
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GuestArch is a QEMU guest architecture identifier, as used in
+// "qemu-system-<GuestArch>" and the -cpu/-machine flags.
+type GuestArch string
+
+// Supported guest architectures.
+const (
+	GuestArchI386    GuestArch = "i386"
+	GuestArchX8664   GuestArch = "x86_64"
+	GuestArchArm     GuestArch = "arm"
+	GuestArchAarch64 GuestArch = "aarch64"
+)
+
+// goarchToGuestArch maps GOARCH to the GuestArch QEMU expects.
+var goarchToGuestArch = map[string]GuestArch{
+	"386":   GuestArchI386,
+	"amd64": GuestArchX8664,
+	"arm":   GuestArchArm,
+	"arm64": GuestArchAarch64,
+}
+
+// ErrKernelRequiredForArgs is returned by Cmdline when kernel arguments
+// were requested (either via Options.KernelArgs or a device implementing
+// KArgsDevice) but no kernel is configured to apply them to.
+var ErrKernelRequiredForArgs = errors.New("a kernel is required to set kernel args")
+
+// ErrUnsupportedArch is returned by Arch when no guest architecture was
+// requested and the host's GOARCH has no known QEMU equivalent.
+var ErrUnsupportedArch = errors.New("unsupported host architecture")
+
+// IDAllocator hands out unique, sequential QEMU object IDs per prefix, so
+// that multiple devices of the same kind (e.g. two disks) don't collide
+// on ahci0/drive0 and the like.
+type IDAllocator struct {
+	mu   sync.Mutex
+	next map[string]int
+}
+
+// NewIDAllocator returns an empty IDAllocator.
+func NewIDAllocator() *IDAllocator {
+	return &IDAllocator{next: make(map[string]int)}
+}
+
+// ID returns the next unused index for prefix, starting at 0.
+func (a *IDAllocator) ID(prefix string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := a.next[prefix]
+	a.next[prefix] = id + 1
+	return id
+}
+
+// Device is a QEMU device or backend that contributes arguments to the
+// QEMU command line, such as a disk, a NIC, or a monitor socket.
+type Device interface {
+	// Cmdline returns the QEMU arguments for this device. alloc should
+	// be used to allocate any QEMU object IDs the device needs, so that
+	// multiple instances of the same device type don't clash.
+	Cmdline(alloc *IDAllocator) []string
+}
+
+// KArgsDevice is implemented by devices that contribute to the guest
+// kernel command line (-append) rather than to QEMU's own arguments.
+type KArgsDevice interface {
+	KArgs() []string
+}
+
+// ArbitraryKernelArgs appends its elements verbatim to the guest kernel
+// command line.
+type ArbitraryKernelArgs []string
+
+// KArgs implements KArgsDevice.
+func (a ArbitraryKernelArgs) KArgs() []string { return a }
+
+// Cmdline implements Device. ArbitraryKernelArgs only contributes kernel
+// args, so it has no QEMU-side arguments of its own.
+func (a ArbitraryKernelArgs) Cmdline(*IDAllocator) []string { return nil }
+
+// IDEBlockDevice attaches Path as an AHCI/IDE hard disk.
+type IDEBlockDevice struct {
+	Path string
+}
+
+// Cmdline implements Device.
+func (d IDEBlockDevice) Cmdline(alloc *IDAllocator) []string {
+	n := alloc.ID("ide")
+	drive := fmt.Sprintf("drive%d", n)
+	bus := fmt.Sprintf("ahci%d", n)
+	return []string{
+		"-drive", fmt.Sprintf("file=%s,if=none,id=%s", d.Path, drive),
+		"-device", fmt.Sprintf("ich9-ahci,id=%s", bus),
+		"-device", fmt.Sprintf("ide-hd,drive=%s,bus=%s.0", drive, bus),
+	}
+}
+
+// Options configures a QEMU command line and the VM it starts.
+//
+// Most fields fall back to a VMTEST_* environment variable when unset, so
+// that a test binary's CI invocation can configure QEMU globally while
+// individual tests only specify what's unique to them.
+type Options struct {
+	// QEMUPath is the QEMU binary to run, plus any extra arguments to
+	// pass it. Falls back to the VMTEST_QEMU environment variable, and
+	// then to "qemu-system-<QEMUArch>".
+	QEMUPath string
+
+	// QEMUArch is the guest architecture to run. Falls back to the
+	// VMTEST_QEMU_ARCH environment variable, and then to the host's
+	// GOARCH.
+	QEMUArch GuestArch
+
+	// Kernel is the path to a kernel image for -kernel. Falls back to
+	// the VMTEST_KERNEL environment variable.
+	Kernel string
+
+	// Initramfs is the path to an initramfs for -initrd. Falls back to
+	// the VMTEST_INITRAMFS environment variable.
+	Initramfs string
+
+	// KernelArgs are appended to the guest kernel command line via
+	// -append, ahead of any devices' KArgs.
+	KernelArgs string
+
+	// Devices are the QEMU devices to attach, in addition to the
+	// minimal -kernel/-initrd/-append configured above.
+	Devices []Device
+
+	// Accelerator selects the hardware acceleration backend to request
+	// via -accel. Defaults to AccelAuto, which probes the host for
+	// KVM/HVF and falls back to TCG.
+	Accelerator Accelerator
+
+	// SerialOutput, if set, additionally receives a copy of everything
+	// the guest writes to its serial console.
+	SerialOutput io.Writer
+
+	// UUID sets the SMBIOS system UUID via -uuid. Left unset by
+	// default; Pool assigns one per leased VM so that concurrently
+	// running VMs don't present colliding SMBIOS UUIDs.
+	UUID string
+}
+
+// Arch returns the guest architecture Options will run, preferring
+// QEMUArch, then the VMTEST_QEMU_ARCH environment variable, and finally
+// the host's GOARCH.
+func (o *Options) Arch() (GuestArch, error) {
+	if o.QEMUArch != "" {
+		return o.QEMUArch, nil
+	}
+	if env := os.Getenv("VMTEST_QEMU_ARCH"); env != "" {
+		return GuestArch(env), nil
+	}
+	arch, ok := goarchToGuestArch[runtime.GOARCH]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedArch, runtime.GOARCH)
+	}
+	return arch, nil
+}
+
+// Cmdline builds the full QEMU command line, including argv[0].
+//
+// Explicitly set Options fields always take precedence over their
+// VMTEST_* environment variable equivalents.
+func (o *Options) Cmdline() ([]string, error) {
+	path := o.QEMUPath
+	var extra []string
+	if path == "" {
+		if env := os.Getenv("VMTEST_QEMU"); env != "" {
+			fields := strings.Fields(env)
+			path, extra = fields[0], fields[1:]
+		} else {
+			arch, err := o.Arch()
+			if err != nil {
+				return nil, err
+			}
+			path = "qemu-system-" + string(arch)
+		}
+	}
+
+	args := append([]string{path, "-nographic"}, extra...)
+
+	kernel := o.Kernel
+	if kernel == "" {
+		kernel = os.Getenv("VMTEST_KERNEL")
+	}
+	initramfs := o.Initramfs
+	if initramfs == "" {
+		initramfs = os.Getenv("VMTEST_INITRAMFS")
+	}
+	if initramfs != "" {
+		args = append(args, "-initrd", initramfs)
+	}
+	if kernel != "" {
+		args = append(args, "-kernel", kernel)
+	}
+
+	if arch, err := o.Arch(); err == nil {
+		args = append(args, accelArgs(o.Accelerator, arch)...)
+	}
+
+	if o.UUID != "" {
+		args = append(args, "-uuid", o.UUID)
+	}
+
+	kernelArgs := o.KernelArgs
+	alloc := NewIDAllocator()
+	for _, d := range o.Devices {
+		if kd, ok := d.(KArgsDevice); ok {
+			if extra := strings.Join(kd.KArgs(), " "); extra != "" {
+				if kernelArgs == "" {
+					kernelArgs = extra
+				} else {
+					kernelArgs += " " + extra
+				}
+			}
+		}
+		// Mitigations' -cpu flags depend on the resolved Accelerator,
+		// which it has no way to know on its own; set it here rather
+		// than leaving it up to the caller to keep the two fields in
+		// sync.
+		if m, ok := d.(Mitigations); ok {
+			m.Accelerator = o.Accelerator
+			args = append(args, m.Cmdline(alloc)...)
+			continue
+		}
+		args = append(args, d.Cmdline(alloc)...)
+	}
+
+	if kernelArgs != "" {
+		if kernel == "" {
+			return nil, ErrKernelRequiredForArgs
+		}
+		args = append(args, "-append", kernelArgs)
+	}
+
+	return args, nil
+}
+
+// portForwarder is implemented by network devices that resolve host-side
+// forwarded addresses as part of Cmdline.
+type portForwarder interface {
+	ForwardedAddr(name string) (string, bool)
+}
+
+// VM is a running QEMU process.
+type VM struct {
+	// Console is the guest's serial console, which can be used to
+	// synchronize test execution with guest boot progress.
+	Console *Console
+
+	cmd        *exec.Cmd
+	cmdline    []string
+	forwarders []portForwarder
+	qmpSocket  string
+	cleanups   []func()
+	done       chan error
+
+	// poolTempDir is set by Pool.Acquire and removed by Pool.Release.
+	poolTempDir string
+
+	// qmp and qmpReady guard the VM's single QMP connection: QEMU's
+	// -qmp monitor only accepts one client, so the panic watcher and
+	// QMP both use the connection dialed by connectQMP rather than
+	// opening their own.
+	qmp      *QMPClient
+	qmpReady chan struct{}
+}
+
+// imageCreator is implemented by devices that may need to create their
+// backing image file before QEMU starts.
+type imageCreator interface {
+	createImage() error
+}
+
+// preparer is implemented by devices that need to finalize some
+// generated state (e.g. a socket path) before Cmdline is rendered.
+type preparer interface {
+	prepare() error
+}
+
+// cleaner is implemented by devices that allocated host-side resources
+// (e.g. a generated temp dir) that must be removed once the VM exits.
+type cleaner interface {
+	cleanup()
+}
+
+// Start runs QEMU according to o and returns once the process has been
+// launched; it does not wait for the guest to finish booting.
+func (o *Options) Start() (*VM, error) {
+	var qmpDev *QMP
+	var cleanups []func()
+	for _, d := range o.Devices {
+		if ic, ok := d.(imageCreator); ok {
+			if err := ic.createImage(); err != nil {
+				return nil, err
+			}
+		}
+		if p, ok := d.(preparer); ok {
+			if err := p.prepare(); err != nil {
+				return nil, err
+			}
+		}
+		if c, ok := d.(cleaner); ok {
+			cleanups = append(cleanups, c.cleanup)
+		}
+		if q, ok := d.(*QMP); ok {
+			qmpDev = q
+		}
+	}
+
+	args, err := o.Cmdline()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+
+	pr, pw := io.Pipe()
+	var serial io.Writer = pw
+	if o.SerialOutput != nil {
+		serial = io.MultiWriter(pw, o.SerialOutput)
+	}
+	cmd.Stdout = serial
+	cmd.Stderr = serial
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start QEMU: %w", err)
+	}
+
+	var forwarders []portForwarder
+	for _, d := range o.Devices {
+		if f, ok := d.(portForwarder); ok {
+			forwarders = append(forwarders, f)
+		}
+	}
+
+	vm := &VM{
+		Console:    &Console{r: pr},
+		cmd:        cmd,
+		cmdline:    args,
+		forwarders: forwarders,
+		cleanups:   cleanups,
+		done:       make(chan error, 1),
+		qmpReady:   make(chan struct{}),
+	}
+	if qmpDev != nil {
+		vm.qmpSocket = qmpDev.SocketPath
+	}
+
+	var panicked atomic.Bool
+	if vm.qmpSocket != "" {
+		go vm.connectQMP(&panicked)
+	} else {
+		close(vm.qmpReady)
+	}
+	go func() {
+		waitErr := cmd.Wait()
+		pw.Close()
+
+		<-vm.qmpReady
+		if vm.qmp != nil {
+			vm.qmp.Close()
+		}
+		for _, cleanup := range vm.cleanups {
+			cleanup()
+		}
+
+		vm.done <- classifyExit(waitErr, panicked.Load())
+	}()
+	return vm, nil
+}
+
+// connectQMP dials the VM's QMP socket once, then watches for a
+// GUEST_PANICKED event for the lifetime of the VM so Wait can
+// distinguish a kernel panic from a clean exit. The resulting
+// connection is also handed out by VM.QMP, since QEMU's QMP monitor
+// only accepts a single client. qmpReady is closed as soon as the
+// connection is established, not once this goroutine's event-drain
+// loop exits, so VM.QMP can be used against a VM that is still
+// running rather than only once it's already exiting.
+func (vm *VM) connectQMP(panicked *atomic.Bool) {
+	var c *QMPClient
+	for i := 0; i < 50; i++ {
+		var err error
+		if c, err = DialQMP(vm.qmpSocket); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if c == nil {
+		close(vm.qmpReady)
+		return
+	}
+	vm.qmp = c
+	close(vm.qmpReady)
+
+	for ev := range c.Events() {
+		if ev.Name == "GUEST_PANICKED" {
+			panicked.Store(true)
+		}
+	}
+}
+
+// ExitKind categorizes why a VM's QEMU process exited, as reported by
+// Wait/WaitContext.
+type ExitKind int
+
+// Exit kinds returned in an *ExitError.
+const (
+	// ExitUnknown means QEMU exited with an error and no more specific
+	// cause was observed. A clean exit yields no *ExitError at all.
+	ExitUnknown ExitKind = iota
+	// ExitGuestPanic means a GUEST_PANICKED QMP event was observed
+	// before QEMU exited.
+	ExitGuestPanic
+	// ExitTimeout means the context passed to WaitContext expired
+	// before QEMU exited.
+	ExitTimeout
+)
+
+// ExitError reports why a VM exited, wrapping the underlying
+// os/exec.Cmd.Wait or context error, if any.
+type ExitError struct {
+	Kind ExitKind
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	switch e.Kind {
+	case ExitGuestPanic:
+		return "qemu: guest kernel panicked"
+	case ExitTimeout:
+		return fmt.Sprintf("qemu: timed out waiting for VM to exit: %v", e.Err)
+	default:
+		if e.Err != nil {
+			return e.Err.Error()
+		}
+		return "qemu: process exited"
+	}
+}
+
+// Unwrap returns the underlying error, if any.
+func (e *ExitError) Unwrap() error { return e.Err }
+
+func classifyExit(waitErr error, guestPanicked bool) error {
+	if guestPanicked {
+		return &ExitError{Kind: ExitGuestPanic, Err: waitErr}
+	}
+	if waitErr != nil {
+		return &ExitError{Kind: ExitUnknown, Err: waitErr}
+	}
+	return nil
+}
+
+// CmdlineQuoted returns the command line as a shell-quoted string,
+// suitable for logging or for re-running the VM by hand.
+func (vm *VM) CmdlineQuoted() string {
+	quoted := make([]string, len(vm.cmdline))
+	for i, arg := range vm.cmdline {
+		if strings.ContainsAny(arg, " \t\n'\"") {
+			quoted[i] = fmt.Sprintf("%q", arg)
+		} else {
+			quoted[i] = arg
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Wait blocks until QEMU exits and returns its exit error, if any, as an
+// *ExitError.
+func (vm *VM) Wait() error {
+	return <-vm.done
+}
+
+// WaitContext blocks until QEMU exits or ctx is done, whichever comes
+// first. If ctx expires first, it returns an *ExitError with Kind
+// ExitTimeout; vm.Wait will still return the eventual exit status.
+func (vm *VM) WaitContext(ctx context.Context) error {
+	select {
+	case err := <-vm.done:
+		return err
+	case <-ctx.Done():
+		return &ExitError{Kind: ExitTimeout, Err: ctx.Err()}
+	}
+}
+
+// QMP returns a client for runtime control (query-status, stop/cont,
+// device_add/device_del) and event subscription, blocking until the VM's
+// QMP connection is established. It returns an error if no QMP device
+// was configured via Options.Devices, or if the connection could not be
+// established.
+//
+// The returned client is shared by the VM (QEMU's QMP monitor only
+// accepts a single connection) and is closed automatically when the VM
+// exits; callers must not call its Close method.
+func (vm *VM) QMP() (*QMPClient, error) {
+	if vm.qmpSocket == "" {
+		return nil, fmt.Errorf("qemu: no QMP device configured on this VM")
+	}
+	<-vm.qmpReady
+	if vm.qmp == nil {
+		return nil, fmt.Errorf("qemu: failed to connect to QMP socket %s", vm.qmpSocket)
+	}
+	return vm.qmp, nil
+}
+
+// ForwardedPort returns the resolved host address ("host:port") for the
+// named hostfwd rule configured via a UserNetwork device, and reports
+// whether a rule with that name was found. It is only meaningful after
+// Start has been called.
+func (vm *VM) ForwardedPort(name string) (string, bool) {
+	for _, f := range vm.forwarders {
+		if addr, ok := f.ForwardedAddr(name); ok {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// Console is a line-oriented view of a VM's serial console output, used
+// to synchronize test execution with guest boot progress.
+type Console struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	r   io.Reader
+	s   *bufio.Scanner
+}
+
+// ExpectString blocks until search appears in the console output and
+// returns everything read up to and including the matching line. If the
+// console closes (guest exit) or errors before a match is found, it
+// returns the output collected so far along with the error.
+func (c *Console) ExpectString(search string) (string, error) {
+	// Reuse one scanner across calls so lines it has already buffered
+	// past a previous match are not lost.
+	if c.s == nil {
+		c.s = bufio.NewScanner(c.r)
+	}
+	s := c.s
+	for s.Scan() {
+		c.mu.Lock()
+		c.buf.Write(s.Bytes())
+		c.buf.WriteByte('\n')
+		out := c.buf.String()
+		c.mu.Unlock()
+		if strings.Contains(s.Text(), search) {
+			return out, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return c.buf.String(), err
+	}
+	return c.buf.String(), io.EOF
+}
@@ -117,14 +117,16 @@ func TestCmdline(t *testing.T) {
 		{
 			name: "simple",
 			o: &Options{
-				QEMUPath: "qemu",
-				QEMUArch: GuestArchX8664,
-				Kernel:   "./foobar",
+				QEMUPath:    "qemu",
+				QEMUArch:    GuestArchX8664,
+				Kernel:      "./foobar",
+				Accelerator: AccelTCG,
 			},
 			want: []cmdlineEqualOpt{
 				withArgv0("qemu"),
 				withArg("-nographic"),
 				withArg("-kernel", "./foobar"),
+				withArg("-accel", "tcg"),
 			},
 		},
 		{
@@ -148,12 +150,13 @@ func TestCmdline(t *testing.T) {
 		{
 			name: "kernel-args-initrd-with-precedence-over-env",
 			o: &Options{
-				QEMUPath:   "qemu",
-				QEMUArch:   GuestArchX8664,
-				Kernel:     "./foobar",
-				Initramfs:  "./initrd",
-				KernelArgs: "printk=ttyS0",
-				Devices:    []Device{ArbitraryKernelArgs{"earlyprintk=ttyS0"}},
+				QEMUPath:    "qemu",
+				QEMUArch:    GuestArchX8664,
+				Kernel:      "./foobar",
+				Initramfs:   "./initrd",
+				KernelArgs:  "printk=ttyS0",
+				Devices:     []Device{ArbitraryKernelArgs{"earlyprintk=ttyS0"}},
+				Accelerator: AccelTCG,
 			},
 			envv: map[string]string{
 				"VMTEST_QEMU":      "qemu-system-x86_64 -enable-kvm -m 1G",
@@ -166,21 +169,24 @@ func TestCmdline(t *testing.T) {
 				withArg("-nographic"),
 				withArg("-kernel", "./foobar"),
 				withArg("-initrd", "./initrd"),
+				withArg("-accel", "tcg"),
 				withArg("-append", "printk=ttyS0 earlyprintk=ttyS0"),
 			},
 		},
 		{
 			name: "device-kernel-args",
 			o: &Options{
-				QEMUPath: "qemu",
-				QEMUArch: GuestArchX8664,
-				Kernel:   "./foobar",
-				Devices:  []Device{ArbitraryKernelArgs{"earlyprintk=ttyS0"}},
+				QEMUPath:    "qemu",
+				QEMUArch:    GuestArchX8664,
+				Kernel:      "./foobar",
+				Devices:     []Device{ArbitraryKernelArgs{"earlyprintk=ttyS0"}},
+				Accelerator: AccelTCG,
 			},
 			want: []cmdlineEqualOpt{
 				withArgv0("qemu"),
 				withArg("-nographic"),
 				withArg("-kernel", "./foobar"),
+				withArg("-accel", "tcg"),
 				withArg("-append", "earlyprintk=ttyS0"),
 			},
 		},
@@ -194,6 +200,7 @@ func TestCmdline(t *testing.T) {
 					IDEBlockDevice{"./disk1"},
 					IDEBlockDevice{"./disk2"},
 				},
+				Accelerator: AccelTCG,
 			},
 			want: []cmdlineEqualOpt{
 				withArgv0("qemu"),
@@ -205,11 +212,12 @@ func TestCmdline(t *testing.T) {
 				withArg("-drive", "file=./disk2,if=none,id=drive1",
 					"-device", "ich9-ahci,id=ahci1",
 					"-device", "ide-hd,drive=drive1,bus=ahci1.0"),
+				withArg("-accel", "tcg"),
 			},
 		},
 		{
 			name: "env-config",
-			o:    &Options{},
+			o:    &Options{Accelerator: AccelTCG},
 			envv: map[string]string{
 				"VMTEST_QEMU":      "qemu-system-x86_64 -enable-kvm -m 1G",
 				"VMTEST_QEMU_ARCH": "x86_64",
@@ -222,6 +230,7 @@ func TestCmdline(t *testing.T) {
 				withArg("-enable-kvm", "-m", "1G"),
 				withArg("-initrd", "./init.cpio"),
 				withArg("-kernel", "./foobar"),
+				withArg("-accel", "tcg"),
 			},
 		},
 	} {
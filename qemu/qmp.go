@@ -0,0 +1,54 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// QMP exposes a QEMU Machine Protocol socket on the VM, i.e. `-qmp
+// unix:path,server,nowait`, giving tests runtime control over the guest
+// (via VM.QMP) beyond what's possible by only watching the serial
+// console.
+type QMP struct {
+	// SocketPath is the UNIX socket QEMU listens on. Callers should set
+	// this under a self-cleaning directory such as a test's
+	// t.TempDir(). If left empty, Start generates one under a fresh
+	// temp directory and removes it once the VM exits.
+	SocketPath string
+
+	generatedDir string
+}
+
+// Cmdline implements Device.
+func (q *QMP) Cmdline(*IDAllocator) []string {
+	return []string{"-qmp", fmt.Sprintf("unix:%s,server,nowait", q.SocketPath)}
+}
+
+// prepare implements preparer: it fills in SocketPath if unset, which
+// must happen before Cmdline is rendered.
+func (q *QMP) prepare() error {
+	if q.SocketPath != "" {
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "vmtest-qmp-")
+	if err != nil {
+		return fmt.Errorf("creating QMP socket dir: %w", err)
+	}
+	q.generatedDir = dir
+	q.SocketPath = filepath.Join(dir, "qmp.sock")
+	return nil
+}
+
+// cleanup implements cleaner: it removes the directory generated by
+// prepare, if any. Caller-supplied SocketPath directories (e.g. a
+// t.TempDir()) are left alone, since the caller owns their lifetime.
+func (q *QMP) cleanup() {
+	if q.generatedDir != "" {
+		os.RemoveAll(q.generatedDir)
+	}
+}
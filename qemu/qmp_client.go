@@ -0,0 +1,178 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// QMPEvent is a QEMU Machine Protocol event, e.g. SHUTDOWN, RESET, or
+// GUEST_PANICKED.
+type QMPEvent struct {
+	Name string
+	Data json.RawMessage
+}
+
+// QMPClient is a connection to a running VM's QMP socket. Commands are
+// executed one at a time; use Events to receive asynchronous events
+// (SHUTDOWN, RESET, GUEST_PANICKED, ...) concurrently with issuing
+// commands.
+type QMPClient struct {
+	conn net.Conn
+
+	mu   sync.Mutex // serializes command execution
+	resp chan qmpMessage
+
+	events chan QMPEvent
+}
+
+type qmpMessage struct {
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *qmpError       `json:"error,omitempty"`
+	Event  string          `json:"event,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string { return fmt.Sprintf("%s: %s", e.Class, e.Desc) }
+
+type qmpGreeting struct {
+	QMP struct {
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+type qmpCommand struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+// DialQMP connects to the QMP socket at socketPath and negotiates
+// capabilities, readying the connection for Execute.
+func DialQMP(socketPath string) (*QMPClient, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("dialing QMP socket %s: %w", socketPath, err)
+	}
+
+	c := &QMPClient{
+		conn:   conn,
+		resp:   make(chan qmpMessage),
+		events: make(chan QMPEvent, 16),
+	}
+
+	dec := json.NewDecoder(conn)
+	var greeting qmpGreeting
+	if err := dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading QMP greeting: %w", err)
+	}
+
+	go c.readLoop(dec)
+
+	if err := c.Execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("negotiating QMP capabilities: %w", err)
+	}
+	return c, nil
+}
+
+// readLoop demultiplexes incoming QMP messages: events go to the events
+// channel, command responses go to resp for whichever Execute call is
+// currently waiting.
+func (c *QMPClient) readLoop(dec *json.Decoder) {
+	defer close(c.events)
+	defer close(c.resp)
+	for {
+		var msg qmpMessage
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		if msg.Event != "" {
+			select {
+			case c.events <- QMPEvent{Name: msg.Event, Data: msg.Data}:
+			default: // drop if nobody's listening; events are best-effort
+			}
+			continue
+		}
+		c.resp <- msg
+	}
+}
+
+// Execute runs a QMP command and, if out is non-nil, decodes its
+// "return" value into it.
+func (c *QMPClient) Execute(command string, arguments, out any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := json.NewEncoder(c.conn).Encode(qmpCommand{Execute: command, Arguments: arguments}); err != nil {
+		return fmt.Errorf("sending QMP command %q: %w", command, err)
+	}
+	msg, ok := <-c.resp
+	if !ok {
+		return fmt.Errorf("QMP connection closed while waiting for %q response", command)
+	}
+	if msg.Error != nil {
+		return fmt.Errorf("QMP command %q failed: %w", command, msg.Error)
+	}
+	if out != nil && len(msg.Return) > 0 {
+		return json.Unmarshal(msg.Return, out)
+	}
+	return nil
+}
+
+// QueryStatus returns the guest's current run state (e.g. "running",
+// "paused", "shutdown"), via query-status.
+func (c *QMPClient) QueryStatus() (string, error) {
+	var out struct {
+		Status string `json:"status"`
+	}
+	if err := c.Execute("query-status", nil, &out); err != nil {
+		return "", err
+	}
+	return out.Status, nil
+}
+
+// SystemPowerdown requests a graceful guest shutdown.
+func (c *QMPClient) SystemPowerdown() error {
+	return c.Execute("system_powerdown", nil, nil)
+}
+
+// Stop pauses guest execution.
+func (c *QMPClient) Stop() error { return c.Execute("stop", nil, nil) }
+
+// Cont resumes guest execution after Stop.
+func (c *QMPClient) Cont() error { return c.Execute("cont", nil, nil) }
+
+// DeviceAdd hot-plugs a device of the given driver and id, with
+// additional driver-specific properties (e.g. "drive", "netdev", "mac"),
+// the QMP primitive that hot-plugging a Drive or network Device at
+// runtime rides on.
+func (c *QMPClient) DeviceAdd(driver, id string, props map[string]any) error {
+	args := map[string]any{"driver": driver, "id": id}
+	for k, v := range props {
+		args[k] = v
+	}
+	return c.Execute("device_add", args, nil)
+}
+
+// DeviceDel removes a previously hot-plugged device by id.
+func (c *QMPClient) DeviceDel(id string) error {
+	return c.Execute("device_del", map[string]string{"id": id}, nil)
+}
+
+// Events returns the channel QMP events (SHUTDOWN, RESET, GUEST_PANICKED,
+// ...) are delivered on. It is closed when the QMP connection closes.
+func (c *QMPClient) Events() <-chan QMPEvent { return c.events }
+
+// Close closes the underlying QMP connection.
+func (c *QMPClient) Close() error { return c.conn.Close() }
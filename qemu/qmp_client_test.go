@@ -0,0 +1,160 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeQMPServer is a minimal QMP server used to exercise QMPClient
+// against the real wire protocol: a JSON greeting, a qmp_capabilities
+// handshake, and then whatever the test drives it to do.
+type fakeQMPServer struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+func (s *fakeQMPServer) accept(l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		s.t.Fatalf("accept: %v", err)
+	}
+	s.conn = conn
+	s.dec = json.NewDecoder(conn)
+}
+
+func (s *fakeQMPServer) send(v any) {
+	s.t.Helper()
+	if err := json.NewEncoder(s.conn).Encode(v); err != nil {
+		s.t.Fatalf("sending %v: %v", v, err)
+	}
+}
+
+func (s *fakeQMPServer) recvCommand() qmpCommand {
+	s.t.Helper()
+	var cmd qmpCommand
+	if err := s.dec.Decode(&cmd); err != nil {
+		s.t.Fatalf("receiving command: %v", err)
+	}
+	return cmd
+}
+
+// startFakeQMPServer listens on a fresh UNIX socket, sends the QMP
+// greeting and acks qmp_capabilities, and returns the socket path and a
+// handle for driving the rest of the session.
+func startFakeQMPServer(t *testing.T) (path string, srv *fakeQMPServer) {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "qmp.sock")
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listening on %s: %v", sock, err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	srv = &fakeQMPServer{t: t}
+	ready := make(chan struct{})
+	go func() {
+		srv.accept(l)
+		srv.send(qmpGreeting{})
+		close(ready)
+		if cmd := srv.recvCommand(); cmd.Execute != "qmp_capabilities" {
+			t.Errorf("first command = %q, want qmp_capabilities", cmd.Execute)
+		}
+		srv.send(qmpMessage{Return: json.RawMessage(`{}`)})
+	}()
+
+	<-ready
+	return sock, srv
+}
+
+func TestQMPClientQueryStatus(t *testing.T) {
+	sock, srv := startFakeQMPServer(t)
+
+	c, err := DialQMP(sock)
+	if err != nil {
+		t.Fatalf("DialQMP: %v", err)
+	}
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cmd := srv.recvCommand()
+		if cmd.Execute != "query-status" {
+			t.Errorf("command = %q, want query-status", cmd.Execute)
+		}
+		srv.send(qmpMessage{Return: json.RawMessage(`{"status":"running"}`)})
+	}()
+
+	status, err := c.QueryStatus()
+	if err != nil {
+		t.Fatalf("QueryStatus: %v", err)
+	}
+	if status != "running" {
+		t.Errorf("QueryStatus = %q, want running", status)
+	}
+	<-done
+}
+
+func TestQMPClientEvents(t *testing.T) {
+	sock, srv := startFakeQMPServer(t)
+
+	c, err := DialQMP(sock)
+	if err != nil {
+		t.Fatalf("DialQMP: %v", err)
+	}
+	defer c.Close()
+
+	srv.send(qmpMessage{Event: "GUEST_PANICKED"})
+
+	select {
+	case ev := <-c.Events():
+		if ev.Name != "GUEST_PANICKED" {
+			t.Errorf("event = %q, want GUEST_PANICKED", ev.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+// TestQMPClientExecuteUnblocksOnDisconnect guards against readLoop only
+// closing the events channel and never c.resp: if the server goes away
+// while Execute is waiting on a response, Execute must return an error
+// rather than hang forever.
+func TestQMPClientExecuteUnblocksOnDisconnect(t *testing.T) {
+	sock, srv := startFakeQMPServer(t)
+
+	c, err := DialQMP(sock)
+	if err != nil {
+		t.Fatalf("DialQMP: %v", err)
+	}
+	defer c.Close()
+
+	go func() {
+		srv.recvCommand() // the query-status we're about to send
+		srv.conn.Close()  // disconnect instead of responding
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.QueryStatus()
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("QueryStatus = nil error after server disconnect, want error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Execute hung after the QMP connection was closed")
+	}
+}
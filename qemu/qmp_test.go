@@ -0,0 +1,120 @@
+// Copyright 2018 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qemu
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQMPPrepareGeneratesSocketPath(t *testing.T) {
+	q := &QMP{}
+	if err := q.prepare(); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	if q.SocketPath == "" {
+		t.Fatal("prepare did not set SocketPath")
+	}
+
+	got := q.Cmdline(NewIDAllocator())
+	want := []string{"-qmp", "unix:" + q.SocketPath + ",server,nowait"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Cmdline = %v, want %v", got, want)
+	}
+}
+
+func TestQMPCleanupRemovesGeneratedDir(t *testing.T) {
+	q := &QMP{}
+	if err := q.prepare(); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	dir := q.generatedDir
+	if dir == "" {
+		t.Fatal("prepare did not record generatedDir")
+	}
+
+	q.cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("cleanup did not remove %s: %v", dir, err)
+	}
+}
+
+func TestQMPCleanupLeavesCallerSuppliedDirAlone(t *testing.T) {
+	dir := t.TempDir()
+	q := &QMP{SocketPath: filepath.Join(dir, "qmp.sock")}
+	if err := q.prepare(); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+
+	q.cleanup()
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("cleanup removed caller-supplied dir %s: %v", dir, err)
+	}
+}
+
+// TestVMQMPAvailableWhileRunning guards against qmpReady being closed
+// only once connectQMP's event-drain loop exits (i.e. once the VM is
+// already gone): VM.QMP must unblock as soon as the QMP connection is
+// dialed, while the VM is still very much alive.
+func TestVMQMPAvailableWhileRunning(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "sleeper.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nsleep 2\n"), 0o755); err != nil {
+		t.Fatalf("writing sleeper script: %v", err)
+	}
+
+	q := &QMP{}
+	vm, err := (&Options{
+		QEMUPath:    script,
+		Accelerator: AccelTCG,
+		Devices:     []Device{q},
+	}).Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer vm.Wait()
+
+	if vm.qmpSocket == "" {
+		t.Fatal("Start did not set qmpSocket")
+	}
+	l, err := net.Listen("unix", vm.qmpSocket)
+	if err != nil {
+		t.Fatalf("listening on %s: %v", vm.qmpSocket, err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		json.NewEncoder(conn).Encode(qmpGreeting{})
+		json.NewDecoder(conn).Decode(new(qmpCommand))
+		json.NewEncoder(conn).Encode(qmpMessage{Return: json.RawMessage(`{}`)})
+	}()
+
+	start := time.Now()
+	if _, err := vm.QMP(); err != nil {
+		t.Fatalf("QMP: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("QMP took %s to become available, want well under the VM's 2s lifetime", elapsed)
+	}
+}
+
+func TestExitErrorKinds(t *testing.T) {
+	if err := classifyExit(nil, false); err != nil {
+		t.Errorf("classifyExit(nil, false) = %v, want nil", err)
+	}
+	if err := classifyExit(nil, true); err == nil {
+		t.Error("classifyExit(nil, true) = nil, want ExitGuestPanic error")
+	} else if ee, ok := err.(*ExitError); !ok || ee.Kind != ExitGuestPanic {
+		t.Errorf("classifyExit(nil, true) = %v, want ExitGuestPanic", err)
+	}
+}